@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// coverSidecarNames are the filenames checked, in order, next to a song's
+// source file when it has no embedded cover art.
+var coverSidecarNames = []string{"cover.jpg", "cover.jpeg", "cover.png", "cover.webp"}
+
+func coverSidecarPath(songAbsPath string) (path string, ok bool) {
+	dir := filepath.Dir(songAbsPath)
+	for _, name := range coverSidecarNames {
+		candidate := filepath.Join(dir, name)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// coverCachePath returns the extensionless path under which s's cover art
+// (the original and any resized thumbnails) is cached; removeGlob uses
+// coverCachePath(s)+".*" to evict all of them together. The original is
+// cached as "orig.<ext>" and thumbnails as "thumb<size>.<ext>" under that
+// path; the original itself is found by globbing coverOriginalGlob(s),
+// which matches only the original, not coverCachePath(s)+".*", which also
+// matches cached thumbnails.
+func coverCachePath(s *Song) string {
+	return filepath.Join(streamDirPath, s.ID+".cover")
+}
+
+// coverOriginalGlob returns the glob pattern matching only s's cached
+// original cover art, never a resized thumbnail.
+func coverOriginalGlob(s *Song) string {
+	return coverCachePath(s) + ".orig.*"
+}
+
+func coverExt(b []byte) string {
+	switch http.DetectContentType(b) {
+	case "image/png":
+		return ".png"
+	case "image/webp":
+		return ".webp"
+	default:
+		return ".jpg"
+	}
+}
+
+func coverMime(ext string) string {
+	switch ext {
+	case ".png":
+		return "image/png"
+	case ".webp":
+		return "image/webp"
+	default:
+		return "image/jpeg"
+	}
+}
+
+// cacheCover materializes s's cover art, extracted once from embedded (the
+// art returned by s's TagReader, if any) or from a cover.{jpg,png,webp}
+// file next to the source, under coverCachePath(s). Callers should treat a
+// non-nil error as "no cover available" rather than fail the whole reload.
+func (l *Library) cacheCover(s *Song, embedded io.Reader) (ext string, ok bool, err error) {
+	var b []byte
+	if embedded != nil {
+		if b, err = ioutil.ReadAll(embedded); err != nil {
+			return "", false, err
+		}
+		ext = coverExt(b)
+	} else if src, found := coverSidecarPath(l.absPath(s.Path)); found {
+		if b, err = ioutil.ReadFile(src); err != nil {
+			return "", false, err
+		}
+		ext = filepath.Ext(src)
+	} else {
+		return "", false, nil
+	}
+	if err = ioutil.WriteFile(coverCachePath(s)+".orig"+ext, b, 0666); err != nil {
+		return "", false, err
+	}
+	return ext, true, nil
+}
+
+func lyricsSidecarPath(songAbsPath string) string {
+	return strings.TrimSuffix(songAbsPath, filepath.Ext(songAbsPath)) + ".lrc"
+}
+
+// lyricsCachePath returns the extensionless path under which s's lyrics
+// are cached; the actual file is lyricsCachePath(s)+".lrc" or
+// lyricsCachePath(s)+".txt".
+func lyricsCachePath(s *Song) string {
+	return filepath.Join(streamDirPath, s.ID+".lyrics")
+}
+
+func isLRC(lyrics string) bool {
+	return strings.HasPrefix(strings.TrimSpace(lyrics), "[")
+}
+
+// cacheLyrics materializes s's lyrics, preferring a .lrc file next to the
+// source over the embedded USLT/LYRICS tag returned by s's TagReader, under
+// lyricsCachePath(s). Callers should treat a non-nil error as "no lyrics
+// available" rather than fail the whole reload.
+func (l *Library) cacheLyrics(s *Song, embedded string) (ext string, ok bool, err error) {
+	if b, rerr := ioutil.ReadFile(lyricsSidecarPath(l.absPath(s.Path))); rerr == nil {
+		if err = ioutil.WriteFile(lyricsCachePath(s)+".lrc", b, 0666); err != nil {
+			return "", false, err
+		}
+		return ".lrc", true, nil
+	}
+	if embedded == "" {
+		return "", false, nil
+	}
+	ext = ".txt"
+	if isLRC(embedded) {
+		ext = ".lrc"
+	}
+	if err = ioutil.WriteFile(lyricsCachePath(s)+ext, []byte(embedded), 0666); err != nil {
+		return "", false, err
+	}
+	return ext, true, nil
+}
+
+// EncodeImage produces an aspect-preserving thumbnail of src, scaled to
+// size pixels wide, at dest, using ffmpeg's scale filter. It reuses the
+// same per-destination mutex map as Encode and EncodeHLS so that parallel
+// requests for the same size don't launch duplicate ffmpeg jobs.
+func (e *Encoder) EncodeImage(src string, dest string, size int) error {
+	e.mutex.Lock()
+	mutex, ok := e.encoding[dest]
+	if !ok {
+		mutex = &sync.Mutex{}
+		e.encoding[dest] = mutex
+	}
+	e.mutex.Unlock()
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, err := os.Stat(dest); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	args := []string{
+		"-i", src,
+		"-vf", fmt.Sprintf("scale=%d:-1", size),
+		"-frames:v", "1",
+		dest,
+	}
+	if err := exec.Command(e.convCmd, args...).Run(); err != nil {
+		os.Remove(dest)
+		return err
+	}
+	return nil
+}
+
+func songIDFromSubPath(urlPath string) string {
+	dir, _ := path.Split(urlPath)
+	return path.Base(strings.TrimSuffix(dir, "/"))
+}
+
+// getCover serves a song's cached cover art, producing a resized thumbnail
+// on demand (and caching it alongside the original) when ?size=NNN is
+// given.
+func (l *Library) getCover(w http.ResponseWriter, r *http.Request) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	s, ok := l.SongsByID[songIDFromSubPath(r.URL.Path)]
+	if !ok {
+		httpError(w, http.StatusNotFound)
+		return
+	}
+	matches, _ := filepath.Glob(coverOriginalGlob(s))
+	if len(matches) == 0 {
+		httpError(w, http.StatusNotFound)
+		return
+	}
+	src := matches[0]
+	ext := filepath.Ext(src)
+	sizeParam := r.URL.Query().Get("size")
+	if sizeParam == "" {
+		w.Header().Set("Content-Type", coverMime(ext))
+		http.ServeFile(w, r, src)
+		return
+	}
+	size, err := strconv.Atoi(sizeParam)
+	if err != nil || size <= 0 {
+		httpError(w, http.StatusBadRequest)
+		return
+	}
+	dest := fmt.Sprintf("%s.thumb%d%s", coverCachePath(s), size, ext)
+	if err := l.enc.EncodeImage(src, dest, size); err != nil {
+		httpError(w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", coverMime(ext))
+	http.ServeFile(w, r, dest)
+}
+
+// getLyrics serves a song's cached lyrics, as LRC when available or plain
+// text otherwise.
+func (l *Library) getLyrics(w http.ResponseWriter, r *http.Request) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	s, ok := l.SongsByID[songIDFromSubPath(r.URL.Path)]
+	if !ok {
+		httpError(w, http.StatusNotFound)
+		return
+	}
+	if matches, _ := filepath.Glob(lyricsCachePath(s) + ".lrc"); len(matches) > 0 {
+		w.Header().Set("Content-Type", "application/x-subrip")
+		http.ServeFile(w, r, matches[0])
+		return
+	}
+	if matches, _ := filepath.Glob(lyricsCachePath(s) + ".txt"); len(matches) > 0 {
+		w.Header().Set("Content-Type", "text/plain")
+		http.ServeFile(w, r, matches[0])
+		return
+	}
+	httpError(w, http.StatusNotFound)
+}
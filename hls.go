@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// hlsSegmentSeconds is the target duration, in seconds, of each HLS media
+// segment.
+const hlsSegmentSeconds = 10
+
+// HLSVariant describes one bitrate/codec rendition offered in an HLS master
+// playlist.
+type HLSVariant struct {
+	// Name identifies the variant and its segment cache subdirectory.
+	Name string
+	// Bandwidth is the variant's approximate bitrate in bits/sec, used in
+	// the master playlist's BANDWIDTH attribute.
+	Bandwidth int
+	// Afmt is the underlying encode used to produce this variant.
+	Afmt Afmt
+	// SegmentExt is the container extension of this variant's segments.
+	SegmentExt string
+}
+
+// hlsVariants are the bitrate tiers offered by the master playlist, ordered
+// from lowest to highest bandwidth.
+var hlsVariants = []HLSVariant{
+	{
+		Name:       "64k",
+		Bandwidth:  64000,
+		SegmentExt: "m4s",
+		Afmt: Afmt{
+			Fmt:     "hls",
+			Codec:   "opus",
+			Encoder: "libopus",
+			Mime:    "audio/mp4",
+			Args: []string{
+				"-b:a", "64000",
+				"-compression_level", "0",
+			},
+		},
+	},
+	{
+		Name:       "128k",
+		Bandwidth:  128000,
+		SegmentExt: "m4s",
+		Afmt: Afmt{
+			Fmt:     "hls",
+			Codec:   "opus",
+			Encoder: "libopus",
+			Mime:    "audio/mp4",
+			Args: []string{
+				"-b:a", "128000",
+				"-compression_level", "0",
+			},
+		},
+	},
+	{
+		Name:       "192k",
+		Bandwidth:  192000,
+		SegmentExt: "ts",
+		Afmt: Afmt{
+			Fmt:     "hls",
+			Codec:   "mp3",
+			Encoder: "libmp3lame",
+			Mime:    "audio/mpeg",
+			Args: []string{
+				"-b:a", "192000",
+			},
+		},
+	},
+}
+
+func hlsVariant(name string) (HLSVariant, bool) {
+	for _, v := range hlsVariants {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return HLSVariant{}, false
+}
+
+// hlsDir returns the directory under which s's HLS playlists and segments
+// are cached.
+func hlsDir(s *Song) string {
+	return filepath.Join(streamDirPath, s.ID)
+}
+
+func hlsVariantDir(s *Song, v HLSVariant) string {
+	return filepath.Join(hlsDir(s), v.Name)
+}
+
+func hlsPlaylistPath(s *Song, v HLSVariant) string {
+	return filepath.Join(hlsVariantDir(s, v), "index.m3u8")
+}
+
+// EncodeHLS segments src into dir as an HLS media playlist and a set of
+// segments in the format described by v, reusing the same per-destination
+// mutex map as Encode so that parallel range requests for the same variant
+// don't launch duplicate ffmpeg jobs.
+func (e *Encoder) EncodeHLS(s *Song, dir string, src string, v HLSVariant) error {
+	e.mutex.Lock()
+	mutex, ok := e.encoding[dir]
+	if !ok {
+		mutex = &sync.Mutex{}
+		e.encoding[dir] = mutex
+	}
+	e.mutex.Unlock()
+	mutex.Lock()
+	defer mutex.Unlock()
+	playlist := filepath.Join(dir, "index.m3u8")
+	if _, err := os.Stat(playlist); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	args := []string{
+		"-i", src,
+		"-codec", v.Afmt.Encoder,
+		"-metadata", fmt.Sprintf("artist=%s", s.Artist),
+		"-metadata", fmt.Sprintf("album=%s", s.Album),
+		"-metadata", fmt.Sprintf("disc=%d", s.Disc),
+		"-metadata", fmt.Sprintf("track=%d", s.Track),
+		"-metadata", fmt.Sprintf("title=%s", s.Title),
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(hlsSegmentSeconds),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(dir, "seg%03d."+v.SegmentExt),
+	}
+	if v.SegmentExt == "m4s" {
+		args = append(args,
+			"-hls_segment_type", "fmp4",
+			"-hls_fmp4_init_filename", "init.mp4")
+	}
+	args = append(args, v.Afmt.Args...)
+	args = append(args, playlist)
+	if err := exec.Command(e.convCmd, args...).Run(); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	return nil
+}
+
+// getHLSMaster serves a master playlist referencing one media playlist per
+// variant in hlsVariants, letting the client pick a rendition based on
+// available bandwidth.
+func (l *Library) getHLSMaster(w http.ResponseWriter, r *http.Request) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	base := path.Base(r.URL.Path)
+	id := strings.TrimSuffix(base, path.Ext(base))
+	s, ok := l.SongsByID[id]
+	if !ok {
+		httpError(w, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	fmt.Fprintln(w, "#EXTM3U")
+	for _, v := range hlsVariants {
+		fmt.Fprintf(w, "#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"%s\"\n",
+			v.Bandwidth, v.Afmt.Codec)
+		fmt.Fprintf(w, "/songs/%s/%s.m3u8\n", s.ID, v.Name)
+	}
+}
+
+// getHLSMedia serves the media playlist for a single variant, encoding its
+// segments on demand if they aren't already cached.
+func (l *Library) getHLSMedia(w http.ResponseWriter, r *http.Request) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	dir, _ := path.Split(r.URL.Path)
+	id := path.Base(dir)
+	name := strings.TrimSuffix(path.Base(r.URL.Path), ".m3u8")
+	s, ok := l.SongsByID[id]
+	if !ok {
+		httpError(w, http.StatusNotFound)
+		return
+	}
+	v, ok := hlsVariant(name)
+	if !ok {
+		httpError(w, http.StatusNotFound)
+		return
+	}
+	if err := l.enc.EncodeHLS(s, hlsVariantDir(s, v), l.absPath(s.Path), v); err != nil {
+		httpError(w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	http.ServeFile(w, r, hlsPlaylistPath(s, v))
+}
+
+// getHLSSegment serves a single segment (or, for fmp4 variants, the
+// init.mp4 initialization segment) of a variant, encoding the whole variant
+// on demand if it hasn't been produced yet.
+func (l *Library) getHLSSegment(w http.ResponseWriter, r *http.Request) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/songs/"), "/")
+	if len(parts) != 3 {
+		httpError(w, http.StatusNotFound)
+		return
+	}
+	id, name, seg := parts[0], parts[1], parts[2]
+	s, ok := l.SongsByID[id]
+	if !ok {
+		httpError(w, http.StatusNotFound)
+		return
+	}
+	v, ok := hlsVariant(name)
+	if !ok {
+		httpError(w, http.StatusNotFound)
+		return
+	}
+	if err := l.enc.EncodeHLS(s, hlsVariantDir(s, v), l.absPath(s.Path), v); err != nil {
+		httpError(w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", v.Afmt.Mime)
+	http.ServeFile(w, r, filepath.Join(hlsVariantDir(s, v), seg))
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Playlist represents a named, ordered list of Songs.
+type Playlist struct {
+	// ID is the unique ID of the Playlist.
+	ID string `json:"id"`
+	// Name is the Playlist's name.
+	Name string `json:"name"`
+	// Owner is the Playlist's owner.
+	Owner string `json:"owner"`
+	// SongIDs are the IDs of the Songs in the Playlist, in order.
+	SongIDs []string `json:"songIDs"`
+	// Created is when the Playlist was created.
+	Created time.Time `json:"created"`
+	// Modified is the last time the Playlist was changed.
+	Modified time.Time `json:"modified"`
+	// Source is the library-relative path of the .m3u/.m3u8 file this
+	// Playlist was imported from, if any. Re-importing the same Source
+	// updates the existing Playlist rather than creating a duplicate.
+	Source string `json:"source,omitempty"`
+}
+
+type m3uEntry struct {
+	artist string
+	title  string
+	path   string
+}
+
+func splitArtistTitle(extinf string) (artist, title string, ok bool) {
+	i := strings.Index(extinf, ",")
+	if i < 0 {
+		return "", "", false
+	}
+	parts := strings.SplitN(extinf[i+1:], " - ", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), true
+}
+
+// parseM3U parses the #EXTINF/path entries of an extended M3U playlist.
+// Plain M3U files (no #EXTINF) are also accepted; their entries carry no
+// artist/title hint.
+func parseM3U(r io.Reader) []m3uEntry {
+	var entries []m3uEntry
+	var pending *m3uEntry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#EXTINF:") {
+			var e m3uEntry
+			if artist, title, ok := splitArtistTitle(strings.TrimPrefix(line, "#EXTINF:")); ok {
+				e.artist, e.title = artist, title
+			}
+			pending = &e
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		e := m3uEntry{path: line}
+		if pending != nil {
+			e.artist, e.title = pending.artist, pending.title
+			pending = nil
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// resolveM3UEntry resolves e to an existing Song, matching its path
+// relative to dir first and falling back to a fold-compare of artist and
+// title.
+func (l *Library) resolveM3UEntry(dir string, e m3uEntry) (*Song, bool) {
+	if e.path != "" {
+		abs := e.path
+		if !filepath.IsAbs(abs) {
+			abs = filepath.Join(dir, e.path)
+		}
+		if rel, err := l.relPath(abs); err == nil {
+			if s, ok := l.SongsByPath[rel]; ok {
+				return s, true
+			}
+		}
+	}
+	if e.artist == "" && e.title == "" {
+		return nil, false
+	}
+	for _, s := range l.sorted {
+		if artistEq, _ := compareFold(s.Artist, e.artist); !artistEq {
+			continue
+		}
+		if titleEq, _ := compareFold(s.Title, e.title); titleEq {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// importM3U imports the playlist read from body, or from the library-
+// relative source file if body is nil, creating a new Playlist or
+// updating the one previously imported from the same source.
+func (l *Library) importM3U(source string, body io.Reader) (*Playlist, error) {
+	dir := l.Path
+	if body == nil {
+		f, err := os.Open(l.absPath(source))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		body = f
+		dir = filepath.Dir(l.absPath(source))
+	}
+	entries := parseM3U(body)
+	songIDs := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if s, ok := l.resolveM3UEntry(dir, e); ok {
+			songIDs = append(songIDs, s.ID)
+		}
+	}
+	now := time.Now()
+	if source != "" {
+		for _, p := range l.PlaylistsByID {
+			if p.Source == source {
+				p.SongIDs = songIDs
+				p.Modified = now
+				return p, nil
+			}
+		}
+	}
+	name := "Playlist"
+	if source != "" {
+		name = strings.TrimSuffix(filepath.Base(source), filepath.Ext(source))
+	}
+	id, err := genID(idLength)
+	if err != nil {
+		return nil, err
+	}
+	p := &Playlist{
+		ID:       id,
+		Name:     name,
+		SongIDs:  songIDs,
+		Created:  now,
+		Modified: now,
+		Source:   source,
+	}
+	l.PlaylistsByID[id] = p
+	return p, nil
+}
+
+// scanPlaylists imports or refreshes every playlist file under l.Path
+// matching l.playlistGlob, the same way reload() picks up new and changed
+// songs.
+func (l *Library) scanPlaylists() {
+	filepath.Walk(l.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		matched, err := filepath.Match(l.playlistGlob, filepath.Base(path))
+		if err != nil || !matched {
+			return nil
+		}
+		rel, err := l.relPath(path)
+		if err != nil {
+			return nil
+		}
+		l.importM3U(rel, nil)
+		return nil
+	})
+}
+
+// exportM3U writes p as an extended M3U playlist.
+func (l *Library) exportM3U(w io.Writer, p *Playlist) {
+	fmt.Fprintln(w, "#EXTM3U")
+	for _, id := range p.SongIDs {
+		s, ok := l.SongsByID[id]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(w, "#EXTINF:-1,%s - %s\n", s.Artist, s.Title)
+		fmt.Fprintf(w, "/songs/%s\n", s.ID)
+	}
+}
+
+type playlistRequest struct {
+	Name    string   `json:"name"`
+	Owner   string   `json:"owner"`
+	SongIDs []string `json:"songIDs"`
+}
+
+func (l *Library) getPlaylists(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	playlists := make([]*Playlist, 0, len(l.PlaylistsByID))
+	for _, p := range l.PlaylistsByID {
+		playlists = append(playlists, p)
+	}
+	sort.Slice(playlists, func(i, j int) bool {
+		if eq, less := compareFold(playlists[i].Name, playlists[j].Name); !eq {
+			return less
+		}
+		return playlists[i].ID < playlists[j].ID
+	})
+	json.NewEncoder(w).Encode(playlists)
+}
+
+func (l *Library) putPlaylists(w http.ResponseWriter, r *http.Request) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, err := l.importM3U("", r.Body); err != nil {
+		httpError(w, http.StatusInternalServerError)
+		return err
+	}
+	if err := l.marshal(); err != nil {
+		httpError(w, http.StatusInternalServerError)
+		return err
+	}
+	return nil
+}
+
+func (l *Library) postPlaylists(w http.ResponseWriter, r *http.Request) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var req playlistRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest)
+		return
+	}
+	id, err := genID(idLength)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	p := &Playlist{
+		ID:       id,
+		Name:     req.Name,
+		Owner:    req.Owner,
+		SongIDs:  req.SongIDs,
+		Created:  now,
+		Modified: now,
+	}
+	l.PlaylistsByID[id] = p
+	if err := l.marshal(); err != nil {
+		httpError(w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+func (l *Library) getPlaylist(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	p, ok := l.PlaylistsByID[path.Base(r.URL.Path)]
+	if !ok {
+		httpError(w, http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(p)
+}
+
+func (l *Library) getPlaylistExport(w http.ResponseWriter, r *http.Request) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	base := path.Base(r.URL.Path)
+	p, ok := l.PlaylistsByID[strings.TrimSuffix(base, path.Ext(base))]
+	if !ok {
+		httpError(w, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	l.exportM3U(w, p)
+}
+
+func (l *Library) putPlaylist(w http.ResponseWriter, r *http.Request) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	p, ok := l.PlaylistsByID[path.Base(r.URL.Path)]
+	if !ok {
+		httpError(w, http.StatusNotFound)
+		return errors.New("playlist not found")
+	}
+	var req playlistRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest)
+		return err
+	}
+	p.Name = req.Name
+	p.Owner = req.Owner
+	p.SongIDs = req.SongIDs
+	p.Modified = time.Now()
+	if err := l.marshal(); err != nil {
+		httpError(w, http.StatusInternalServerError)
+		return err
+	}
+	return nil
+}
+
+func (l *Library) postPlaylist(w http.ResponseWriter, r *http.Request) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	p, ok := l.PlaylistsByID[path.Base(r.URL.Path)]
+	if !ok {
+		httpError(w, http.StatusNotFound)
+		return
+	}
+	var req playlistRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest)
+		return
+	}
+	p.SongIDs = append(p.SongIDs, req.SongIDs...)
+	p.Modified = time.Now()
+	if err := l.marshal(); err != nil {
+		httpError(w, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+func (l *Library) deletePlaylist(w http.ResponseWriter, r *http.Request) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	id := path.Base(r.URL.Path)
+	if _, ok := l.PlaylistsByID[id]; !ok {
+		httpError(w, http.StatusNotFound)
+		return
+	}
+	delete(l.PlaylistsByID, id)
+	if err := l.marshal(); err != nil {
+		httpError(w, http.StatusInternalServerError)
+		return
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"crypto/rand"
 	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
 	"golang.org/x/crypto/bcrypt"
@@ -15,10 +14,8 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
-	"reflect"
 	"regexp"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -36,15 +33,19 @@ const (
 )
 
 const (
-	fportName = "port"
-	fcertName = "cert"
-	fkeyName  = "key"
+	fportName         = "port"
+	fcertName         = "cert"
+	fkeyName          = "key"
+	fwatchName        = "watch"
+	fplaylistGlobName = "playlist-glob"
 )
 
 const (
 	httpOptions = "OPTIONS"
 	httpGet     = "GET"
 	httpPut     = "PUT"
+	httpPost    = "POST"
+	httpDelete  = "DELETE"
 )
 
 // Afmt represents an audio format supported by ffmpeg/avconv.
@@ -105,6 +106,12 @@ type Song struct {
 	Fmt string `json:"fmt"`
 	// Codec is the Song's codec in ffprobe/avprobe.
 	Codec string `json:"codec"`
+	// HasCover reports whether cover art is available at
+	// /songs/{id}/cover.
+	HasCover bool `json:"hasCover"`
+	// HasLyrics reports whether lyrics are available at
+	// /songs/{id}/lyrics.
+	HasLyrics bool `json:"hasLyrics"`
 }
 
 // ByTags sorts Songs case-insensitively with the following priority:
@@ -202,55 +209,24 @@ type Library struct {
 	SongsByPath map[string]*Song `json:"songsByPath"`
 	// SongsByID maps Song.IDs to Songs.
 	SongsByID map[string]*Song `json:"songsByID"`
-	sorted    []*Song
-	probeCmd  string
-	mutex     *sync.RWMutex
-	enc       *Encoder
-	hash      []byte
-	songRE    *regexp.Regexp
-	streamRE  *regexp.Regexp
-}
-
-func isKind(val interface{}, kind reflect.Kind) bool {
-	return reflect.TypeOf(val).Kind() == kind
-}
-
-func (l *Library) probeCmdError() error {
-	return fmt.Errorf("malformed %s output", l.probeCmd)
-}
-
-type tags struct {
-	Format  map[string]interface{}   `json:"format"`
-	Streams []map[string]interface{} `json:"streams"`
-}
-
-func valRaw(key string, cont map[string]interface{}) (val string, ok bool) {
-	tags, ok := cont["tags"].(map[string]interface{})
-	if !ok {
-		return
-	}
-	if val, ok = tags[strings.ToLower(key)].(string); ok {
-		return val, ok
-	}
-	val, ok = tags[strings.ToUpper(key)].(string)
-	return
-}
-
-func (t tags) val(key string) (val string, ok bool) {
-	if val, ok := valRaw(key, t.Format); ok {
-		return val, ok
-	}
-	for _, stream := range t.Streams {
-		if val, ok := valRaw(key, stream); ok {
-			return val, ok
-		}
-	}
-	return
-}
-
-func valInt(valString string) (val int) {
-	val, _ = strconv.Atoi(strings.Split(valString, "/")[0])
-	return
+	// PlaylistsByID maps Playlist.IDs to Playlists.
+	PlaylistsByID    map[string]*Playlist `json:"playlistsByID"`
+	sorted           []*Song
+	probeCmd         string
+	mutex            *sync.RWMutex
+	enc              *Encoder
+	hash             []byte
+	songRE           *regexp.Regexp
+	streamRE         *regexp.Regexp
+	hlsMasterRE      *regexp.Regexp
+	hlsMediaRE       *regexp.Regexp
+	hlsSegmentRE     *regexp.Regexp
+	coverRE          *regexp.Regexp
+	lyricsRE         *regexp.Regexp
+	playlistRE       *regexp.Regexp
+	playlistExportRE *regexp.Regexp
+	playlistGlob     string
+	reader           TagReader
 }
 
 func (l *Library) absPath(path string) string {
@@ -276,58 +252,11 @@ func genID(length int) (string, error) {
 
 func (l *Library) newSong(path string) (s *Song, err error) {
 	abs := l.absPath(path)
-	cmd := exec.Command(l.probeCmd,
-		"-print_format", "json",
-		"-show_format",
-		"-show_streams",
-		abs)
-	stdout, err := cmd.StdoutPipe()
+	s, cover, lyrics, err := l.reader.Read(abs)
 	if err != nil {
-		return
-	}
-	if err = cmd.Start(); err != nil {
-		return
-	}
-	var t tags
-	if err = json.NewDecoder(stdout).Decode(&t); err != nil {
-		return
-	}
-	if err = cmd.Wait(); err != nil {
-		return
-	}
-	score, ok := t.Format["probe_score"]
-	if !ok || !isKind(score, reflect.Float64) {
-		return nil, l.probeCmdError()
-	}
-	if score.(float64) < 25 {
-		return nil, errors.New("undeterminable file type")
-	}
-	fmt, ok := t.Format["format_name"]
-	if !ok || !isKind(fmt, reflect.String) {
-		return nil, l.probeCmdError()
-	}
-	s = &Song{
-		Path: path,
-		Fmt:  fmt.(string),
-	}
-	audio := false
-	for _, stream := range t.Streams {
-		codecTypeRaw, ok := stream["codec_type"]
-		if !ok || !isKind(codecTypeRaw, reflect.String) {
-			return nil, l.probeCmdError()
-		}
-		if codecType := codecTypeRaw.(string); codecType == "audio" {
-			audio = true
-			codec := stream["codec_name"]
-			if !ok || !isKind(codec, reflect.String) {
-				return nil, l.probeCmdError()
-			}
-			s.Codec = codec.(string)
-		}
-	}
-	if !audio {
-		return nil, errors.New("no audio stream")
+		return nil, err
 	}
+	s.Path = path
 	sOld, ok := l.SongsByPath[s.Path]
 	if ok {
 		s.ID = sOld.ID
@@ -348,19 +277,12 @@ func (l *Library) newSong(path string) (s *Song, err error) {
 	}
 	s.Time = fi.ModTime()
 	songFile.Close()
-	s.Artist, _ = t.val("artist")
-	s.Album, _ = t.val("album")
-	disc, ok := t.val("disc")
-	if !ok {
-		disc, _ = t.val("discnumber")
+	if _, ok, cerr := l.cacheCover(s, cover); cerr == nil {
+		s.HasCover = ok
 	}
-	s.Disc = valInt(disc)
-	track, ok := t.val("track")
-	if !ok {
-		track, _ = t.val("tracknumber")
+	if _, ok, lerr := l.cacheLyrics(s, lyrics); lerr == nil {
+		s.HasLyrics = ok
 	}
-	s.Track = valInt(track)
-	s.Title, _ = t.val("title")
 	return
 }
 
@@ -375,9 +297,31 @@ func deleteStream(s *Song) (err error) {
 			return
 		}
 	}
+	if err = os.RemoveAll(hlsDir(s)); err != nil {
+		return
+	}
+	if err = removeGlob(coverCachePath(s) + ".*"); err != nil {
+		return
+	}
+	if err = removeGlob(lyricsCachePath(s) + ".*"); err != nil {
+		return
+	}
 	return
 }
 
+func removeGlob(pattern string) error {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		if err := os.Remove(match); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (l *Library) marshal() (err error) {
 	db, err := os.OpenFile(marshalPath, os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
@@ -431,6 +375,7 @@ func (l *Library) reload() (err error) {
 		l.sorted = append(l.sorted, s)
 	}
 	sort.Sort(ByTags(l.sorted))
+	l.scanPlaylists()
 	err = l.marshal()
 	return
 }
@@ -447,11 +392,15 @@ func chooseCmd(s, t string) (string, error) {
 }
 
 // NewLibrary returns a new Library for path which requires an authentication
-// password whose bcrypt hash compares with hash.
-func NewLibrary(path string, hash []byte) (l *Library, err error) {
+// password whose bcrypt hash compares with hash. If watch is true, a
+// background goroutine keeps the Library in sync with path by reacting to
+// filesystem events instead of requiring a PUT /songs rescan. playlistGlob
+// selects which files under path are auto-imported as playlists on reload.
+func NewLibrary(path string, hash []byte, watch bool, playlistGlob string) (l *Library, err error) {
 	l = &Library{
-		hash:  hash,
-		mutex: &sync.RWMutex{},
+		hash:         hash,
+		mutex:        &sync.RWMutex{},
+		playlistGlob: playlistGlob,
 	}
 	l.probeCmd, err = chooseCmd("ffprobe", "avprobe")
 	if err != nil {
@@ -462,6 +411,7 @@ func NewLibrary(path string, hash []byte) (l *Library, err error) {
 		return nil, err
 	}
 	l.enc = NewEncoder(convCmd)
+	l.reader = chooseTagReader(l.probeCmd)
 	songREFmt := fmt.Sprintf("^\\/songs\\/[%c-%c]{%d}",
 		idLeastByte,
 		idGreatestByte,
@@ -472,6 +422,31 @@ func NewLibrary(path string, hash []byte) (l *Library, err error) {
 	if l.streamRE, err = regexp.Compile(songREFmt + "\\..+$"); err != nil {
 		return nil, err
 	}
+	if l.hlsMasterRE, err = regexp.Compile(songREFmt + "\\.m3u8$"); err != nil {
+		return nil, err
+	}
+	if l.hlsMediaRE, err = regexp.Compile(songREFmt + "\\/[^/]+\\.m3u8$"); err != nil {
+		return nil, err
+	}
+	if l.hlsSegmentRE, err = regexp.Compile(songREFmt + "\\/[^/]+\\/(seg\\d+\\.(ts|m4s)|init\\.mp4)$"); err != nil {
+		return nil, err
+	}
+	if l.coverRE, err = regexp.Compile(songREFmt + "\\/cover$"); err != nil {
+		return nil, err
+	}
+	if l.lyricsRE, err = regexp.Compile(songREFmt + "\\/lyrics$"); err != nil {
+		return nil, err
+	}
+	playlistREFmt := fmt.Sprintf("^\\/playlists\\/[%c-%c]{%d}",
+		idLeastByte,
+		idGreatestByte,
+		idLength)
+	if l.playlistRE, err = regexp.Compile(playlistREFmt + "$"); err != nil {
+		return nil, err
+	}
+	if l.playlistExportRE, err = regexp.Compile(playlistREFmt + "\\.m3u8?$"); err != nil {
+		return nil, err
+	}
 	if db, err := os.Open(marshalPath); err == nil {
 		defer db.Close()
 		if err = json.NewDecoder(db).Decode(l); err != nil {
@@ -483,7 +458,15 @@ func NewLibrary(path string, hash []byte) (l *Library, err error) {
 		l.SongsByPath = make(map[string]*Song)
 		l.SongsByID = make(map[string]*Song)
 	}
+	if l.PlaylistsByID == nil {
+		l.PlaylistsByID = make(map[string]*Playlist)
+	}
 	l.reload()
+	if watch {
+		if err := l.watch(); err != nil {
+			log.Printf("could not watch %s: %v", l.Path, err)
+		}
+	}
 	return
 }
 
@@ -556,7 +539,7 @@ func (l *Library) getStream(w http.ResponseWriter, r *http.Request) {
 func (l *Library) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Headers", "Authorization")
-	if r.Method != httpOptions {
+	if r.Method != httpOptions && !strings.HasPrefix(r.URL.Path, subsonicPrefix) {
 		_, password, ok := r.BasicAuth()
 		if !ok ||
 			bcrypt.CompareHashAndPassword(l.hash, []byte(password)) != nil {
@@ -584,6 +567,47 @@ func (l *Library) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	switch {
+	case strings.HasPrefix(r.URL.Path, subsonicPrefix):
+		l.ServeSubsonic(w, r)
+	case r.URL.Path == "/playlists":
+		handle(map[string]func(){
+			httpGet: func() {
+				l.getPlaylists(w)
+			},
+			httpPut: func() {
+				if err := l.putPlaylists(w, r); err != nil {
+					return
+				}
+				l.getPlaylists(w)
+			},
+			httpPost: func() {
+				l.postPlaylists(w, r)
+			},
+		})
+	case l.playlistExportRE.MatchString(r.URL.Path):
+		handle(map[string]func(){
+			httpGet: func() {
+				l.getPlaylistExport(w, r)
+			},
+		})
+	case l.playlistRE.MatchString(r.URL.Path):
+		handle(map[string]func(){
+			httpGet: func() {
+				l.getPlaylist(w, r)
+			},
+			httpPut: func() {
+				if err := l.putPlaylist(w, r); err != nil {
+					return
+				}
+				l.getPlaylist(w, r)
+			},
+			httpPost: func() {
+				l.postPlaylist(w, r)
+			},
+			httpDelete: func() {
+				l.deletePlaylist(w, r)
+			},
+		})
 	case r.URL.Path == "/songs":
 		handle(map[string]func(){
 			httpPut: func() {
@@ -602,6 +626,36 @@ func (l *Library) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				l.getSong(w, r)
 			},
 		})
+	case l.hlsMasterRE.MatchString(r.URL.Path):
+		handle(map[string]func(){
+			httpGet: func() {
+				l.getHLSMaster(w, r)
+			},
+		})
+	case l.hlsMediaRE.MatchString(r.URL.Path):
+		handle(map[string]func(){
+			httpGet: func() {
+				l.getHLSMedia(w, r)
+			},
+		})
+	case l.hlsSegmentRE.MatchString(r.URL.Path):
+		handle(map[string]func(){
+			httpGet: func() {
+				l.getHLSSegment(w, r)
+			},
+		})
+	case l.coverRE.MatchString(r.URL.Path):
+		handle(map[string]func(){
+			httpGet: func() {
+				l.getCover(w, r)
+			},
+		})
+	case l.lyricsRE.MatchString(r.URL.Path):
+		handle(map[string]func(){
+			httpGet: func() {
+				l.getLyrics(w, r)
+			},
+		})
 	case l.streamRE.MatchString(r.URL.Path):
 		handle(map[string]func(){
 			httpGet: func() {
@@ -624,17 +678,25 @@ func getHash() (hash []byte, err error) {
 	return
 }
 
-const usage = `usage: river [-cert file] [-key file] [-port port] directory
+const usage = `usage: river [-cert file] [-key file] [-port port] [-watch] directory
 
 river serves the music in the given directory. The music can be accessed via a
 client on port 21313, or on the port named by the -port flag. If the -cert and
 -key flags are specified, river will listen for HTTPS connections; otherwise,
-river will listen for HTTP connections.`
+river will listen for HTTP connections. By default, river watches directory
+for changes and updates its library incrementally; pass -watch=false to
+disable this on filesystems where fsnotify is unreliable (e.g. many network
+filesystems), falling back to rescanning on every PUT /songs. Files under
+directory matching the -playlist-glob pattern are imported as playlists on
+every rescan.`
 
 func main() {
 	fcert := flag.String(fcertName, "", "the TLS certificate to use")
 	fkey := flag.String(fkeyName, "", "the TLS key to use")
 	fport := flag.Uint(fportName, 21313, "the port to listen on")
+	fwatch := flag.Bool(fwatchName, true, "watch directory for changes")
+	fplaylistGlob := flag.String(fplaylistGlobName, "*.m3u*",
+		"glob pattern selecting playlist files to auto-import")
 	flag.Usage = func() {
 		fmt.Fprintln(os.Stderr, usage)
 	}
@@ -668,7 +730,7 @@ func main() {
 		log.Fatal(err)
 	}
 	os.Mkdir(streamDirPath, os.ModeDir)
-	l, err := NewLibrary(libraryPath, hash)
+	l, err := NewLibrary(libraryPath, hash, *fwatch, *fplaylistGlob)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"hash/fnv"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// subsonicAPIVersion is the version of the Subsonic API implemented by
+// ServeSubsonic.
+const subsonicAPIVersion = "1.16.1"
+
+// subsonicPrefix is the path prefix routed to ServeSubsonic.
+const subsonicPrefix = "/rest/"
+
+type subsonicError struct {
+	Code    int    `xml:"code,attr" json:"code"`
+	Message string `xml:"message,attr" json:"message"`
+}
+
+type subsonicArtist struct {
+	ID         string `xml:"id,attr" json:"id"`
+	Name       string `xml:"name,attr" json:"name"`
+	AlbumCount int    `xml:"albumCount,attr" json:"albumCount"`
+}
+
+type subsonicIndex struct {
+	Name   string           `xml:"name,attr" json:"name"`
+	Artist []subsonicArtist `xml:"artist" json:"artist"`
+}
+
+type subsonicArtists struct {
+	Index []subsonicIndex `xml:"index" json:"index"`
+}
+
+// subsonicChild describes a single song in the shape Subsonic clients
+// expect for both album contents and search results.
+type subsonicChild struct {
+	ID          string `xml:"id,attr" json:"id"`
+	Parent      string `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	Title       string `xml:"title,attr" json:"title"`
+	Album       string `xml:"album,attr,omitempty" json:"album,omitempty"`
+	Artist      string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	Track       int    `xml:"track,attr,omitempty" json:"track,omitempty"`
+	DiscNumber  int    `xml:"discNumber,attr,omitempty" json:"discNumber,omitempty"`
+	ContentType string `xml:"contentType,attr,omitempty" json:"contentType,omitempty"`
+	Suffix      string `xml:"suffix,attr,omitempty" json:"suffix,omitempty"`
+	CoverArt    string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	IsDir       bool   `xml:"isDir,attr" json:"isDir"`
+}
+
+type subsonicAlbum struct {
+	ID        string          `xml:"id,attr" json:"id"`
+	Name      string          `xml:"name,attr" json:"name"`
+	Artist    string          `xml:"artist,attr" json:"artist"`
+	CoverArt  string          `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	SongCount int             `xml:"songCount,attr" json:"songCount"`
+	Song      []subsonicChild `xml:"song" json:"song"`
+}
+
+type subsonicSearchResult3 struct {
+	Artist []subsonicArtist `xml:"artist" json:"artist"`
+	Song   []subsonicChild  `xml:"song" json:"song"`
+}
+
+type subsonicPlaylist struct {
+	ID        string `xml:"id,attr" json:"id"`
+	Name      string `xml:"name,attr" json:"name"`
+	Owner     string `xml:"owner,attr,omitempty" json:"owner,omitempty"`
+	SongCount int    `xml:"songCount,attr" json:"songCount"`
+	Created   string `xml:"created,attr" json:"created"`
+	Changed   string `xml:"changed,attr" json:"changed"`
+}
+
+type subsonicPlaylists struct {
+	Playlist []subsonicPlaylist `xml:"playlist" json:"playlist"`
+}
+
+type subsonicResponse struct {
+	XMLName       xml.Name               `xml:"subsonic-response" json:"-"`
+	Status        string                 `xml:"status,attr" json:"status"`
+	Version       string                 `xml:"version,attr" json:"version"`
+	Error         *subsonicError         `xml:"error,omitempty" json:"error,omitempty"`
+	Artists       *subsonicArtists       `xml:"artists,omitempty" json:"artists,omitempty"`
+	Album         *subsonicAlbum         `xml:"album,omitempty" json:"album,omitempty"`
+	Song          *subsonicChild         `xml:"song,omitempty" json:"song,omitempty"`
+	SearchResult3 *subsonicSearchResult3 `xml:"searchResult3,omitempty" json:"searchResult3,omitempty"`
+	Playlists     *subsonicPlaylists     `xml:"playlists,omitempty" json:"playlists,omitempty"`
+}
+
+type subsonicEnvelope struct {
+	Response subsonicResponse `json:"subsonic-response"`
+}
+
+func subsonicFail(code int, message string) subsonicResponse {
+	return subsonicResponse{Status: "failed", Error: &subsonicError{Code: code, Message: message}}
+}
+
+// subsonicID hashes parts into a deterministic, Subsonic-shaped ID so that
+// artist and album IDs survive restarts without being persisted separately
+// from the songs they're derived from.
+func subsonicID(kind string, parts ...string) string {
+	h := fnv.New64a()
+	for _, p := range parts {
+		h.Write([]byte(strings.ToLower(p)))
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%s-%x", kind, h.Sum64())
+}
+
+func subsonicArtistID(artist string) string {
+	return subsonicID("ar", artist)
+}
+
+func subsonicAlbumID(artist, album string) string {
+	return subsonicID("al", artist, album)
+}
+
+func subsonicChildFromSong(s *Song, parent string) subsonicChild {
+	contentType := "application/octet-stream"
+	suffix := strings.TrimPrefix(filepath.Ext(s.Path), ".")
+	if af, ok := afmts["."+suffix]; ok {
+		contentType = af.Mime
+	}
+	child := subsonicChild{
+		ID:          s.ID,
+		Parent:      parent,
+		Title:       s.Title,
+		Album:       s.Album,
+		Artist:      s.Artist,
+		Track:       s.Track,
+		DiscNumber:  s.Disc,
+		ContentType: contentType,
+		Suffix:      suffix,
+		IsDir:       false,
+	}
+	if s.HasCover {
+		child.CoverArt = s.ID
+	}
+	return child
+}
+
+// subsonicPlaylistsResponse converts l.PlaylistsByID into the Subsonic
+// playlist listing shape, in the same name-then-ID order getPlaylists uses.
+func (l *Library) subsonicPlaylistsResponse() *subsonicPlaylists {
+	playlists := make([]*Playlist, 0, len(l.PlaylistsByID))
+	for _, p := range l.PlaylistsByID {
+		playlists = append(playlists, p)
+	}
+	sort.Slice(playlists, func(i, j int) bool {
+		if eq, less := compareFold(playlists[i].Name, playlists[j].Name); !eq {
+			return less
+		}
+		return playlists[i].ID < playlists[j].ID
+	})
+	out := make([]subsonicPlaylist, 0, len(playlists))
+	for _, p := range playlists {
+		out = append(out, subsonicPlaylist{
+			ID:        p.ID,
+			Name:      p.Name,
+			Owner:     p.Owner,
+			SongCount: len(p.SongIDs),
+			Created:   p.Created.Format(time.RFC3339),
+			Changed:   p.Modified.Format(time.RFC3339),
+		})
+	}
+	return &subsonicPlaylists{Playlist: out}
+}
+
+// subsonicCoverArt resolves id to a cached cover file, treating id as either
+// a song ID or (since covers are only cached per-Song) the deterministic
+// album ID of an album containing a song with cover art.
+func (l *Library) subsonicCoverArt(id string) (absPath string, ok bool) {
+	s, ok := l.SongsByID[id]
+	if !ok {
+		for _, song := range l.sorted {
+			if song.HasCover && subsonicAlbumID(song.Artist, song.Album) == id {
+				s, ok = song, true
+				break
+			}
+		}
+	}
+	if !ok || !s.HasCover {
+		return "", false
+	}
+	matches, _ := filepath.Glob(coverOriginalGlob(s))
+	if len(matches) == 0 {
+		return "", false
+	}
+	return matches[0], true
+}
+
+// subsonicAuth authenticates a Subsonic request against l.hash. The u=/p=
+// scheme is fully supported, since a plaintext (or hex-encoded) password
+// can be checked with bcrypt the same way HTTP Basic auth is. The t=/s=
+// token scheme (t = md5(password + salt)) can't be verified against a
+// bcrypt hash without knowing the password in advance, so it's rejected
+// rather than silently treated as authenticated.
+func (l *Library) subsonicAuth(r *http.Request) bool {
+	q := r.URL.Query()
+	if p := q.Get("p"); p != "" {
+		if strings.HasPrefix(p, "enc:") {
+			if decoded, err := hex.DecodeString(strings.TrimPrefix(p, "enc:")); err == nil {
+				p = string(decoded)
+			}
+		}
+		return bcrypt.CompareHashAndPassword(l.hash, []byte(p)) == nil
+	}
+	if q.Get("t") != "" && q.Get("s") != "" {
+		return false
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		return bcrypt.CompareHashAndPassword(l.hash, []byte(password)) == nil
+	}
+	return false
+}
+
+func (l *Library) writeSubsonicResponse(w http.ResponseWriter, r *http.Request, resp subsonicResponse) {
+	if resp.Status == "" {
+		resp.Status = "ok"
+	}
+	resp.Version = subsonicAPIVersion
+	if r.URL.Query().Get("f") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(subsonicEnvelope{Response: resp})
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(resp)
+}
+
+// subsonicArtistsResponse synthesizes a Subsonic artist index from l.sorted
+// by grouping the same ByTags ordering the song list already uses.
+func (l *Library) subsonicArtistsResponse() *subsonicArtists {
+	type albumKey struct{ artist, album string }
+	seenAlbums := make(map[albumKey]bool)
+	albumCounts := make(map[string]int)
+	seenArtists := make(map[string]bool)
+	var order []string
+	for _, s := range l.sorted {
+		if !seenArtists[s.Artist] {
+			seenArtists[s.Artist] = true
+			order = append(order, s.Artist)
+		}
+		k := albumKey{s.Artist, s.Album}
+		if !seenAlbums[k] {
+			seenAlbums[k] = true
+			albumCounts[s.Artist]++
+		}
+	}
+	byLetter := make(map[string][]subsonicArtist)
+	var letters []string
+	for _, artist := range order {
+		letter := "#"
+		if artist != "" {
+			letter = strings.ToUpper(string([]rune(artist)[0]))
+		}
+		if _, ok := byLetter[letter]; !ok {
+			letters = append(letters, letter)
+		}
+		byLetter[letter] = append(byLetter[letter], subsonicArtist{
+			ID:         subsonicArtistID(artist),
+			Name:       artist,
+			AlbumCount: albumCounts[artist],
+		})
+	}
+	sort.Strings(letters)
+	indexes := make([]subsonicIndex, 0, len(letters))
+	for _, letter := range letters {
+		indexes = append(indexes, subsonicIndex{Name: letter, Artist: byLetter[letter]})
+	}
+	return &subsonicArtists{Index: indexes}
+}
+
+// subsonicAlbumResponse finds the distinct (Artist, Album) pair whose
+// deterministic ID matches id and returns its songs, or nil if no album
+// has that ID.
+func (l *Library) subsonicAlbumResponse(id string) *subsonicAlbum {
+	var artist, album string
+	var songs []*Song
+	found := false
+	for _, s := range l.sorted {
+		if subsonicAlbumID(s.Artist, s.Album) != id {
+			continue
+		}
+		if !found {
+			artist, album, found = s.Artist, s.Album, true
+		}
+		songs = append(songs, s)
+	}
+	if !found {
+		return nil
+	}
+	children := make([]subsonicChild, 0, len(songs))
+	coverArt := ""
+	for _, s := range songs {
+		children = append(children, subsonicChildFromSong(s, id))
+		if coverArt == "" && s.HasCover {
+			coverArt = s.ID
+		}
+	}
+	return &subsonicAlbum{
+		ID:        id,
+		Name:      album,
+		Artist:    artist,
+		CoverArt:  coverArt,
+		SongCount: len(children),
+		Song:      children,
+	}
+}
+
+// subsonicSearch3Response does a case-insensitive substring match of query
+// against each song's artist, album, and title.
+func (l *Library) subsonicSearch3Response(query string) *subsonicSearchResult3 {
+	query = strings.ToLower(query)
+	seenArtists := make(map[string]bool)
+	var artists []subsonicArtist
+	var songs []subsonicChild
+	for _, s := range l.sorted {
+		match := query == "" ||
+			strings.Contains(strings.ToLower(s.Artist), query) ||
+			strings.Contains(strings.ToLower(s.Album), query) ||
+			strings.Contains(strings.ToLower(s.Title), query)
+		if !match {
+			continue
+		}
+		if !seenArtists[s.Artist] {
+			seenArtists[s.Artist] = true
+			artists = append(artists, subsonicArtist{ID: subsonicArtistID(s.Artist), Name: s.Artist})
+		}
+		songs = append(songs, subsonicChildFromSong(s, subsonicAlbumID(s.Artist, s.Album)))
+	}
+	return &subsonicSearchResult3{Artist: artists, Song: songs}
+}
+
+func (l *Library) subsonicStream(w http.ResponseWriter, r *http.Request) {
+	s, ok := l.SongsByID[r.URL.Query().Get("id")]
+	if !ok {
+		httpError(w, http.StatusNotFound)
+		return
+	}
+	absPath := l.absPath(s.Path)
+	af, ok := afmts["."+r.URL.Query().Get("format")]
+	if !ok {
+		http.ServeFile(w, r, absPath)
+		return
+	}
+	w.Header().Set("Content-Type", af.Mime)
+	if s.Fmt == af.Fmt && s.Codec == af.Codec {
+		http.ServeFile(w, r, absPath)
+		return
+	}
+	dest := streamPath(s, "."+r.URL.Query().Get("format"))
+	if l.enc.Encode(s, dest, absPath, af) != nil {
+		httpError(w, http.StatusInternalServerError)
+		return
+	}
+	http.ServeFile(w, r, dest)
+}
+
+func (l *Library) subsonicDownload(w http.ResponseWriter, r *http.Request) {
+	s, ok := l.SongsByID[r.URL.Query().Get("id")]
+	if !ok {
+		httpError(w, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(s.Path)))
+	http.ServeFile(w, r, l.absPath(s.Path))
+}
+
+// ServeSubsonic handles the Subsonic-compatible surface rooted at
+// subsonicPrefix. It authenticates each request itself from query
+// parameters (or HTTP Basic as a fallback) rather than via the global
+// BasicAuth check in ServeHTTP, since Subsonic clients don't use Basic
+// auth by default.
+func (l *Library) ServeSubsonic(w http.ResponseWriter, r *http.Request) {
+	if !l.subsonicAuth(r) {
+		l.writeSubsonicResponse(w, r, subsonicFail(40, "Wrong username or password"))
+		return
+	}
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	switch strings.TrimSuffix(path.Base(r.URL.Path), ".view") {
+	case "ping":
+		l.writeSubsonicResponse(w, r, subsonicResponse{})
+	case "getArtists":
+		l.writeSubsonicResponse(w, r, subsonicResponse{Artists: l.subsonicArtistsResponse()})
+	case "getAlbum":
+		album := l.subsonicAlbumResponse(r.URL.Query().Get("id"))
+		if album == nil {
+			l.writeSubsonicResponse(w, r, subsonicFail(70, "Album not found"))
+			return
+		}
+		l.writeSubsonicResponse(w, r, subsonicResponse{Album: album})
+	case "getSong":
+		s, ok := l.SongsByID[r.URL.Query().Get("id")]
+		if !ok {
+			l.writeSubsonicResponse(w, r, subsonicFail(70, "Song not found"))
+			return
+		}
+		child := subsonicChildFromSong(s, subsonicAlbumID(s.Artist, s.Album))
+		l.writeSubsonicResponse(w, r, subsonicResponse{Song: &child})
+	case "search3":
+		l.writeSubsonicResponse(w, r, subsonicResponse{SearchResult3: l.subsonicSearch3Response(r.URL.Query().Get("query"))})
+	case "getPlaylists":
+		l.writeSubsonicResponse(w, r, subsonicResponse{Playlists: l.subsonicPlaylistsResponse()})
+	case "scrobble":
+		l.writeSubsonicResponse(w, r, subsonicResponse{})
+	case "stream":
+		l.subsonicStream(w, r)
+	case "download":
+		l.subsonicDownload(w, r)
+	case "getCoverArt":
+		absPath, ok := l.subsonicCoverArt(r.URL.Query().Get("id"))
+		if !ok {
+			l.writeSubsonicResponse(w, r, subsonicFail(70, "Cover art is not available"))
+			return
+		}
+		w.Header().Set("Content-Type", coverMime(filepath.Ext(absPath)))
+		http.ServeFile(w, r, absPath)
+	default:
+		l.writeSubsonicResponse(w, r, subsonicFail(0, "Unknown method"))
+	}
+}
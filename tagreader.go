@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dhowden/tag"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// TagReader extracts a Song's metadata, cover art, and lyrics from its
+// source file at path. The returned Song's ID, Path, and Time are left
+// zero for the caller (Library.newSong) to fill in.
+type TagReader interface {
+	Read(path string) (s *Song, cover io.Reader, lyrics string, err error)
+}
+
+func isKind(val interface{}, kind reflect.Kind) bool {
+	return reflect.TypeOf(val).Kind() == kind
+}
+
+type tags struct {
+	Format  map[string]interface{}   `json:"format"`
+	Streams []map[string]interface{} `json:"streams"`
+}
+
+func valRaw(key string, cont map[string]interface{}) (val string, ok bool) {
+	tags, ok := cont["tags"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	if val, ok = tags[strings.ToLower(key)].(string); ok {
+		return val, ok
+	}
+	val, ok = tags[strings.ToUpper(key)].(string)
+	return
+}
+
+func (t tags) val(key string) (val string, ok bool) {
+	if val, ok := valRaw(key, t.Format); ok {
+		return val, ok
+	}
+	for _, stream := range t.Streams {
+		if val, ok := valRaw(key, stream); ok {
+			return val, ok
+		}
+	}
+	return
+}
+
+func valInt(valString string) (val int) {
+	val, _ = strconv.Atoi(strings.Split(valString, "/")[0])
+	return
+}
+
+// ffprobeTagReader extracts metadata by shelling out to ffprobe/avprobe,
+// the original tag-reading strategy. It never returns cover art or
+// lyrics, since ffprobe's JSON output discards embedded pictures and
+// unsynced lyrics tags.
+type ffprobeTagReader struct {
+	probeCmd string
+}
+
+func (f *ffprobeTagReader) probeCmdError() error {
+	return fmt.Errorf("malformed %s output", f.probeCmd)
+}
+
+func (f *ffprobeTagReader) Read(path string) (s *Song, cover io.Reader, lyrics string, err error) {
+	cmd := exec.Command(f.probeCmd,
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		path)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	var t tags
+	if err = json.NewDecoder(stdout).Decode(&t); err != nil {
+		return
+	}
+	if err = cmd.Wait(); err != nil {
+		return
+	}
+	score, ok := t.Format["probe_score"]
+	if !ok || !isKind(score, reflect.Float64) {
+		return nil, nil, "", f.probeCmdError()
+	}
+	if score.(float64) < 25 {
+		return nil, nil, "", errors.New("undeterminable file type")
+	}
+	fmtName, ok := t.Format["format_name"]
+	if !ok || !isKind(fmtName, reflect.String) {
+		return nil, nil, "", f.probeCmdError()
+	}
+	s = &Song{
+		Fmt: fmtName.(string),
+	}
+	audio := false
+	for _, stream := range t.Streams {
+		codecTypeRaw, ok := stream["codec_type"]
+		if !ok || !isKind(codecTypeRaw, reflect.String) {
+			return nil, nil, "", f.probeCmdError()
+		}
+		if codecType := codecTypeRaw.(string); codecType == "audio" {
+			audio = true
+			codec := stream["codec_name"]
+			if !ok || !isKind(codec, reflect.String) {
+				return nil, nil, "", f.probeCmdError()
+			}
+			s.Codec = codec.(string)
+		}
+	}
+	if !audio {
+		return nil, nil, "", errors.New("no audio stream")
+	}
+	s.Artist, _ = t.val("artist")
+	s.Album, _ = t.val("album")
+	disc, ok := t.val("disc")
+	if !ok {
+		disc, _ = t.val("discnumber")
+	}
+	s.Disc = valInt(disc)
+	track, ok := t.val("track")
+	if !ok {
+		track, _ = t.val("tracknumber")
+	}
+	s.Track = valInt(track)
+	s.Title, _ = t.val("title")
+	return
+}
+
+// fmtCodecFromExt returns the ffmpeg-style Fmt/Codec pair afmts uses for a
+// source file whose extension is ext, so the getStream/subsonicStream
+// passthrough check (s.Fmt == af.Fmt && s.Codec == af.Codec) still
+// recognizes a source that's already in a supported streaming format.
+// tag.Metadata has no codec-level accessor (FileType is a container
+// label, e.g. "MP3" or "OGG"), so dhowdenTagReader can't derive these from
+// the parsed tags the way ffprobeTagReader does from ffprobe's streams.
+// Formats afmts doesn't know always differ from every af.Fmt/af.Codec
+// pair, so they naturally fall through to the encoder.
+func fmtCodecFromExt(ext string) (fmt, codec string) {
+	switch strings.ToLower(ext) {
+	case ".opus":
+		return "ogg", "opus"
+	case ".mp3":
+		return "mp3", "mp3"
+	case ".ogg":
+		return "ogg", "vorbis"
+	case ".flac":
+		return "flac", "flac"
+	case ".m4a", ".aac":
+		return "mov,mp4,m4a,3gp,3g2,mj2", "aac"
+	case ".wav":
+		return "wav", "pcm_s16le"
+	default:
+		return strings.TrimPrefix(ext, "."), strings.TrimPrefix(ext, ".")
+	}
+}
+
+// dhowdenTagReader extracts metadata, cover art, and embedded lyrics using
+// github.com/dhowden/tag, a pure-Go tag parser. Unlike ffprobeTagReader it
+// never forks a subprocess, which matters during reload() walks over
+// libraries with tens of thousands of files.
+type dhowdenTagReader struct{}
+
+func (d *dhowdenTagReader) Read(path string) (s *Song, cover io.Reader, lyrics string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	m, err := tag.ReadFrom(f)
+	if err != nil {
+		return
+	}
+	track, _ := m.Track()
+	disc, _ := m.Disc()
+	fmtName, codec := fmtCodecFromExt(filepath.Ext(path))
+	s = &Song{
+		Artist: m.Artist(),
+		Album:  m.Album(),
+		Disc:   disc,
+		Track:  track,
+		Title:  m.Title(),
+		Fmt:    fmtName,
+		Codec:  codec,
+	}
+	if pic := m.Picture(); pic != nil {
+		cover = bytes.NewReader(pic.Data)
+	}
+	lyrics = m.Lyrics()
+	return
+}
+
+// multiTagReader tries primary first, falling back to fallback only if
+// primary fails, mirroring the ffmpeg/avconv fallback chooseCmd already
+// does for the encoder.
+type multiTagReader struct {
+	primary  TagReader
+	fallback TagReader
+}
+
+func (m *multiTagReader) Read(path string) (s *Song, cover io.Reader, lyrics string, err error) {
+	if s, cover, lyrics, err = m.primary.Read(path); err == nil {
+		return
+	}
+	return m.fallback.Read(path)
+}
+
+// chooseTagReader mirrors chooseCmd: reload() forking an ffprobe process
+// per file is a real bottleneck on libraries with tens of thousands of
+// files, so the pure-Go dhowdenTagReader is always tried first.
+// ffprobeTagReader remains as a fallback for formats dhowden/tag doesn't
+// understand.
+func chooseTagReader(probeCmd string) TagReader {
+	return &multiTagReader{
+		primary:  &dhowdenTagReader{},
+		fallback: &ffprobeTagReader{probeCmd: probeCmd},
+	}
+}
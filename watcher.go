@@ -0,0 +1,180 @@
+package main
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// songLess reports whether a sorts before b under ByTags.
+func songLess(a, b *Song) bool {
+	return ByTags{a, b}.Less(0, 1)
+}
+
+// insertSorted inserts s into l.sorted at its sort.Search position rather
+// than re-sorting the whole slice.
+func (l *Library) insertSorted(s *Song) {
+	i := sort.Search(len(l.sorted), func(i int) bool {
+		return !songLess(l.sorted[i], s)
+	})
+	l.sorted = append(l.sorted, nil)
+	copy(l.sorted[i+1:], l.sorted[i:])
+	l.sorted[i] = s
+}
+
+// removeSorted removes s from l.sorted, which must be sorted and contain
+// s, without re-sorting the whole slice.
+func (l *Library) removeSorted(s *Song) {
+	i := sort.Search(len(l.sorted), func(i int) bool {
+		return !songLess(l.sorted[i], s)
+	})
+	for i < len(l.sorted) && l.sorted[i] != s {
+		i++
+	}
+	if i < len(l.sorted) {
+		l.sorted = append(l.sorted[:i], l.sorted[i+1:]...)
+	}
+}
+
+// watch starts a background goroutine that keeps l in sync with l.Path by
+// reacting to fsnotify events rather than requiring a full filepath.Walk
+// on every PUT /songs. PUT /songs remains available as an explicit
+// rescan-everything escape hatch.
+func (l *Library) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	walkDirs := func(root string) error {
+		return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return nil
+			}
+			return watcher.Add(path)
+		})
+	}
+	if err := walkDirs(l.Path); err != nil {
+		watcher.Close()
+		return err
+	}
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				l.handleWatchEvent(watcher, walkDirs, event)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println(err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (l *Library) handleWatchEvent(watcher *fsnotify.Watcher, walkDirs func(string) error, event fsnotify.Event) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	switch {
+	case event.Op&fsnotify.Create != 0:
+		l.watchCreate(walkDirs, event.Name)
+	case event.Op&fsnotify.Write != 0:
+		l.watchWrite(event.Name)
+	case event.Op&(fsnotify.Rename|fsnotify.Remove) != 0:
+		l.watchRemove(event.Name)
+	}
+}
+
+func (l *Library) watchCreate(walkDirs func(string) error, abs string) {
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return
+	}
+	if fi.IsDir() {
+		walkDirs(abs)
+		filepath.Walk(abs, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			l.watchWrite(path)
+			return nil
+		})
+		return
+	}
+	l.watchWrite(abs)
+}
+
+func (l *Library) watchWrite(abs string) {
+	rel, err := l.relPath(abs)
+	if err != nil {
+		return
+	}
+	if matched, _ := filepath.Match(l.playlistGlob, filepath.Base(abs)); matched {
+		if _, err := l.importM3U(rel, nil); err == nil {
+			l.marshal()
+		}
+		return
+	}
+	sOld, hadOld := l.SongsByPath[rel]
+	if hadOld {
+		deleteStream(sOld)
+	}
+	s, err := l.newSong(rel)
+	if err != nil {
+		return
+	}
+	if hadOld {
+		l.removeSorted(sOld)
+	}
+	l.SongsByPath[rel] = s
+	l.SongsByID[s.ID] = s
+	l.insertSorted(s)
+	l.marshal()
+}
+
+func (l *Library) watchRemove(abs string) {
+	rel, err := l.relPath(abs)
+	if err != nil {
+		return
+	}
+	if s, ok := l.SongsByPath[rel]; ok {
+		delete(l.SongsByPath, rel)
+		delete(l.SongsByID, s.ID)
+		deleteStream(s)
+		l.removeSorted(s)
+		l.marshal()
+		return
+	}
+	l.watchRemoveDir(rel)
+}
+
+// watchRemoveDir purges every tracked Song under the removed directory rel,
+// the mirror image of watchCreate's recursive walk: fsnotify fires only one
+// Remove/Rename event for a directory that held songs, never one per file
+// that was inside it, so rel won't be found directly in l.SongsByPath.
+func (l *Library) watchRemoveDir(rel string) {
+	prefix := rel + string(filepath.Separator)
+	var removed []*Song
+	for p, s := range l.SongsByPath {
+		if p == rel || strings.HasPrefix(p, prefix) {
+			removed = append(removed, s)
+			delete(l.SongsByPath, p)
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+	for _, s := range removed {
+		delete(l.SongsByID, s.ID)
+		deleteStream(s)
+		l.removeSorted(s)
+	}
+	l.marshal()
+}